@@ -0,0 +1,109 @@
+package aghstrings
+
+// OrderedSet is a set of strings that preserves insertion order, so that
+// iterating or dumping it back to a slice always yields the same result for
+// the same sequence of operations.  This makes it suitable for things like
+// upstream or resolver lists, where map-based set operations would shuffle
+// the order on every reconfigure and cause spurious config diffs and log
+// churn.
+//
+// The zero value is not usable; create an OrderedSet with NewOrderedSet.
+type OrderedSet struct {
+	items []string
+	index map[string]int
+}
+
+// NewOrderedSet returns a new *OrderedSet containing the unique elements of
+// items, in the order they first appear.
+func NewOrderedSet(items ...string) (s *OrderedSet) {
+	s = &OrderedSet{
+		items: make([]string, 0, len(items)),
+		index: make(map[string]int, len(items)),
+	}
+
+	for _, it := range items {
+		s.Add(it)
+	}
+
+	return s
+}
+
+// Add appends item to s if it isn't already present.
+func (s *OrderedSet) Add(item string) {
+	if _, ok := s.index[item]; ok {
+		return
+	}
+
+	s.index[item] = len(s.items)
+	s.items = append(s.items, item)
+}
+
+// Delete removes item from s, if present, shifting subsequent items back by
+// one to preserve order.
+func (s *OrderedSet) Delete(item string) {
+	i, ok := s.index[item]
+	if !ok {
+		return
+	}
+
+	s.items = append(s.items[:i], s.items[i+1:]...)
+	delete(s.index, item)
+	for j := i; j < len(s.items); j++ {
+		s.index[s.items[j]] = j
+	}
+}
+
+// Has reports whether item is in s.
+func (s *OrderedSet) Has(item string) (ok bool) {
+	_, ok = s.index[item]
+
+	return ok
+}
+
+// Len returns the number of elements in s.
+func (s *OrderedSet) Len() (n int) {
+	return len(s.items)
+}
+
+// Values returns the elements of s as a slice, in insertion order.  The
+// returned slice must not be modified.
+func (s *OrderedSet) Values() (items []string) {
+	return s.items
+}
+
+// Subtract returns a new *OrderedSet containing the elements of s that are
+// not in other, preserving s's order.
+func (s *OrderedSet) Subtract(other *OrderedSet) (res *OrderedSet) {
+	res = NewOrderedSet()
+	for _, it := range s.items {
+		if !other.Has(it) {
+			res.Add(it)
+		}
+	}
+
+	return res
+}
+
+// Intersect returns a new *OrderedSet containing the elements present in
+// both s and other, preserving s's order.
+func (s *OrderedSet) Intersect(other *OrderedSet) (res *OrderedSet) {
+	res = NewOrderedSet()
+	for _, it := range s.items {
+		if other.Has(it) {
+			res.Add(it)
+		}
+	}
+
+	return res
+}
+
+// Union returns a new *OrderedSet containing every element of s followed by
+// every element of other that isn't already in s.
+func (s *OrderedSet) Union(other *OrderedSet) (res *OrderedSet) {
+	res = NewOrderedSet(s.items...)
+	for _, it := range other.items {
+		res.Add(it)
+	}
+
+	return res
+}
@@ -0,0 +1,44 @@
+package aghstrings_test
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderedSet(t *testing.T) {
+	s := aghstrings.NewOrderedSet("c", "a", "b", "a")
+	assert.Equal(t, []string{"c", "a", "b"}, s.Values())
+	assert.Equal(t, 3, s.Len())
+	assert.True(t, s.Has("a"))
+	assert.False(t, s.Has("z"))
+
+	s.Delete("a")
+	assert.Equal(t, []string{"c", "b"}, s.Values())
+	assert.False(t, s.Has("a"))
+
+	s.Add("a")
+	assert.Equal(t, []string{"c", "b", "a"}, s.Values())
+}
+
+func TestOrderedSet_Subtract(t *testing.T) {
+	a := aghstrings.NewOrderedSet("1", "2", "3")
+	b := aghstrings.NewOrderedSet("2")
+
+	assert.Equal(t, []string{"1", "3"}, a.Subtract(b).Values())
+}
+
+func TestOrderedSet_Intersect(t *testing.T) {
+	a := aghstrings.NewOrderedSet("1", "2", "3")
+	b := aghstrings.NewOrderedSet("3", "1")
+
+	assert.Equal(t, []string{"1", "3"}, a.Intersect(b).Values())
+}
+
+func TestOrderedSet_Union(t *testing.T) {
+	a := aghstrings.NewOrderedSet("1", "2")
+	b := aghstrings.NewOrderedSet("2", "3")
+
+	assert.Equal(t, []string{"1", "2", "3"}, a.Union(b).Values())
+}
@@ -14,11 +14,13 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
@@ -67,16 +69,34 @@ type Server struct {
 	subnetDetector *aghnet.SubnetDetector
 	localResolvers aghnet.Exchanger
 
+	// ptrRouter routes reverse-lookup queries to a named resolver group
+	// based on the client IP's subnet.  It is nil when
+	// ServerConfig.LocalPTRResolvers defines no groups, in which case
+	// localResolvers is used for locally-served networks and the internal
+	// proxy for all other addresses.
+	ptrRouter *PTRRouter
+
 	tableHostToIP     map[string]net.IP // "hostname -> IP" table for internal addresses (DHCP)
 	tableHostToIPLock sync.Mutex
 
 	tablePTR     map[string]string // "IP -> hostname" table for reverse lookup
 	tablePTRLock sync.Mutex
 
+	// rdnsCache memoizes Exchange results for IPs not found in tablePTR,
+	// so that repeated lookups for the same unknown or external IP don't
+	// require network I/O every time.
+	rdnsCache *rdnsCache
+
 	// DNS proxy instance for internal usage
 	// We don't Start() it and so no listen port is required.
 	internalProxy *proxy.Proxy
 
+	// upstreamHealth tracks the active health of the configured upstreams
+	// and orders them by preference.  It is nil before Prepare and after the
+	// server is stopped.  With a zero UpstreamHealthCheck.Interval it is
+	// still set, but runs no periodic checks.
+	upstreamHealth *upstreamHealthChecker
+
 	isRunning bool
 
 	sync.RWMutex
@@ -129,11 +149,22 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 		queryLog:       p.QueryLog,
 		subnetDetector: p.SubnetDetector,
 		autohostSuffix: autohostSuffix,
+		rdnsCache:      newRDNSCache(),
 	}
 
 	if p.DHCPServer != nil {
 		s.dhcpServer = p.DHCPServer
-		s.dhcpServer.SetOnLeaseChanged(s.onDHCPLeaseChanged)
+
+		// Purge the memoized reverse-lookup results whenever a lease is
+		// removed, so that a freed IP doesn't keep answering with the
+		// previous lease's hostname until the cache entry's TTL expires.
+		onLeaseChanged := s.onDHCPLeaseChanged
+		s.dhcpServer.SetOnLeaseChanged(func(flags int) {
+			onLeaseChanged(flags)
+			if flags == dhcpd.LeaseChangedRemoved {
+				s.PurgeRDNSCache()
+			}
+		})
 		s.onDHCPLeaseChanged(dhcpd.LeaseChangedAdded)
 	}
 
@@ -147,7 +178,7 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 
 // NewCustomServer creates a new instance of *Server with custom internal proxy.
 func NewCustomServer(internalProxy *proxy.Proxy) *Server {
-	s := &Server{}
+	s := &Server{rdnsCache: newRDNSCache()}
 	if internalProxy != nil {
 		s.internalProxy = internalProxy
 	}
@@ -178,19 +209,31 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	*c = sc
 	c.RatelimitWhitelist = stringArrayDup(sc.RatelimitWhitelist)
 	c.BootstrapDNS = stringArrayDup(sc.BootstrapDNS)
-	c.AllowedClients = stringArrayDup(sc.AllowedClients)
-	c.DisallowedClients = stringArrayDup(sc.DisallowedClients)
+	// Dedupe and stabilize the order of the access-list fields so that
+	// repeated writes of an unchanged configuration don't produce spurious
+	// diffs.
+	c.AllowedClients = aghstrings.NewOrderedSet(sc.AllowedClients...).Values()
+	c.DisallowedClients = aghstrings.NewOrderedSet(sc.DisallowedClients...).Values()
 	c.BlockedHosts = stringArrayDup(sc.BlockedHosts)
 	c.UpstreamDNS = stringArrayDup(sc.UpstreamDNS)
+	c.UpstreamHealthCheck = sc.UpstreamHealthCheck
+	c.UpstreamStatuses = s.upstreamStatuses()
 	s.RUnlock()
 }
 
 // RDNSSettings returns the copy of actual RDNS configuration.
-func (s *Server) RDNSSettings() (localPTRResolvers []string, resolveClients bool) {
+func (s *Server) RDNSSettings() (localPTRResolvers []PTRResolverGroup, resolveClients bool) {
 	s.RLock()
 	defer s.RUnlock()
 
-	localPTRResolvers = stringArrayDup(s.conf.LocalPTRResolvers)
+	localPTRResolvers = make([]PTRResolverGroup, len(s.conf.LocalPTRResolvers))
+	for i, g := range s.conf.LocalPTRResolvers {
+		localPTRResolvers[i] = PTRResolverGroup{
+			Name:      g.Name,
+			Subnets:   stringArrayDup(g.Subnets),
+			Upstreams: stringArrayDup(g.Upstreams),
+		}
+	}
 	resolveClients = s.conf.ResolveClients
 
 	return localPTRResolvers, resolveClients
@@ -232,6 +275,35 @@ func (s *Server) Exchange(ip net.IP) (host string, err error) {
 		return "", nil
 	}
 
+	ipStr := ip.String()
+
+	// Fast path: the IP is already known from a DHCP lease, so there's no
+	// need to perform any network I/O at all.
+	s.tablePTRLock.Lock()
+	dhcpHost, isDHCPKnown := s.tablePTR[ipStr]
+	s.tablePTRLock.Unlock()
+	if isDHCPKnown {
+		return strings.TrimSuffix(dhcpHost+s.autohostSuffix, "."), nil
+	}
+
+	if cached, found, ok := s.rdnsCache.get(ipStr); found {
+		if !ok {
+			return "", rDNSEmptyAnswerErr
+		}
+
+		return cached, nil
+	}
+
+	host, err = s.exchangeNetwork(ip)
+	s.rdnsCache.set(ipStr, host, err == nil)
+
+	return host, err
+}
+
+// exchangeNetwork performs the actual reverse-resolution network I/O for
+// ip, consulting the PTR router, the local resolvers, or the internal proxy
+// as appropriate.  s must be read-locked by the caller.
+func (s *Server) exchangeNetwork(ip net.IP) (host string, err error) {
 	arpa := dns.Fqdn(aghnet.ReverseAddr(ip))
 	req := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
@@ -247,9 +319,17 @@ func (s *Server) Exchange(ip net.IP) (host string, err error) {
 	}
 
 	var resp *dns.Msg
-	if s.subnetDetector.IsLocallyServedNetwork(ip) {
+	var routed bool
+	if s.ptrRouter != nil {
+		resp, routed, err = s.ptrRouter.Exchange(ip, req)
+	}
+
+	switch {
+	case routed:
+		// Already handled, successfully or not, by a configured PTR route.
+	case s.subnetDetector.IsLocallyServedNetwork(ip):
 		resp, err = s.localResolvers.Exchange(req)
-	} else {
+	default:
 		ctx := &proxy.DNSContext{
 			Proto:     "udp",
 			Req:       req,
@@ -275,6 +355,22 @@ func (s *Server) Exchange(ip net.IP) (host string, err error) {
 	return strings.TrimSuffix(ptr.Ptr, "."), nil
 }
 
+// PurgeRDNSCache drops every memoized reverse-lookup result, both from the
+// rdns cache and from the PTR router's negative-lookup cache.  It should be
+// called whenever the set of known mappings might have changed, e.g. on
+// Reconfigure or when a DHCP lease is removed.
+func (s *Server) PurgeRDNSCache() {
+	s.rdnsCache.purge()
+
+	s.RLock()
+	router := s.ptrRouter
+	s.RUnlock()
+
+	if router != nil {
+		router.Purge()
+	}
+}
+
 // Start starts the DNS server.
 func (s *Server) Start() error {
 	s.Lock()
@@ -293,32 +389,6 @@ func (s *Server) startLocked() error {
 
 const defaultLocalTimeout = 5 * time.Second
 
-// stringsSetSubtract subtracts b from a interpreted as sets.
-//
-// TODO(e.burkov): Move into our internal package for working with strings.
-func stringsSetSubtract(a, b []string) (c []string) {
-	// unit is an object to be used as value in set.
-	type unit = struct{}
-
-	cSet := make(map[string]unit)
-	for _, k := range a {
-		cSet[k] = unit{}
-	}
-
-	for _, k := range b {
-		delete(cSet, k)
-	}
-
-	c = make([]string, len(cSet))
-	i := 0
-	for k := range cSet {
-		c[i] = k
-		i++
-	}
-
-	return c
-}
-
 // collectDNSIPAddrs returns the slice of IP addresses without port number which
 // we are listening on.  For internal use only.
 func (s *Server) collectDNSIPAddrs() (addrs []string, err error) {
@@ -378,13 +448,23 @@ func (s *Server) setupResolvers(localAddrs []string) (err error) {
 	// is not really applicable here since in case of listening on
 	// all network interfaces we should check the whole interface's
 	// network to cut off all the loopback addresses as well.
-	localAddrs = stringsSetSubtract(localAddrs, ourAddrs)
+	localAddrs = aghstrings.NewOrderedSet(localAddrs...).
+		Subtract(aghstrings.NewOrderedSet(ourAddrs...)).
+		Values()
 
 	s.localResolvers, err = aghnet.NewMultiAddrExchanger(localAddrs, defaultLocalTimeout)
 	if err != nil {
 		return err
 	}
 
+	s.ptrRouter = nil
+	if len(s.conf.LocalPTRResolvers) > 0 {
+		s.ptrRouter, err = NewPTRRouter(s.conf.LocalPTRResolvers, defaultLocalTimeout)
+		if err != nil {
+			return fmt.Errorf("setting up ptr router: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -444,10 +524,16 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	// --
 	s.prepareIntlProxy()
 
-	// Initialize DNS access module
+	// Initialize DNS access module.  The allow/disallow lists are deduped
+	// and order-stabilized via aghstrings.OrderedSet, for the same reason
+	// setupResolvers uses it for local addresses: map-based deduping would
+	// otherwise shuffle the order on every reconfigure.
 	// --
+	allowedClients := aghstrings.NewOrderedSet(s.conf.AllowedClients...).Values()
+	disallowedClients := aghstrings.NewOrderedSet(s.conf.DisallowedClients...).Values()
+
 	s.access = &accessCtx{}
-	err = s.access.Init(s.conf.AllowedClients, s.conf.DisallowedClients, s.conf.BlockedHosts)
+	err = s.access.Init(allowedClients, disallowedClients, s.conf.BlockedHosts)
 	if err != nil {
 		return err
 	}
@@ -457,13 +543,46 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	if !webRegistered && s.conf.HTTPRegister != nil {
 		webRegistered = true
 		s.registerHandlers()
+		s.registerUpstreamHealthHandlers()
 	}
 
 	// Create the main DNS proxy instance
 	// --
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
 
-	err = s.setupResolvers(s.conf.LocalPTRResolvers)
+	// Set up active upstream health checking so that the proxy prefers the
+	// healthiest reachable upstream instead of static round-robin.  The
+	// applyOrder callback replaces s.dnsProxy.Upstreams with the reordered
+	// list after every round of checks, which is what the proxy actually
+	// consults when selecting an upstream.  Start calls it once
+	// synchronously, while the caller of Prepare may already hold s's lock
+	// (Reconfigure does), so that first call writes the field directly.
+	// Later calls come from the checker's background goroutine or from the
+	// recheck handler, so they take s.Lock() themselves.
+	// --
+	started := make(chan struct{})
+	s.upstreamHealth = newUpstreamHealthChecker(proxyConfig.Upstreams, s.conf.UpstreamHealthCheck)
+	s.upstreamHealth.Start(proxyConfig.Upstreams, func(ordered []upstream.Upstream) {
+		select {
+		case <-started:
+			s.Lock()
+			defer s.Unlock()
+		default:
+		}
+
+		s.dnsProxy.Upstreams = ordered
+	})
+	close(started)
+
+	// setupResolvers takes the flat list of addresses to use as the base
+	// local resolvers; derive it from the configured PTR resolver groups,
+	// since ServerConfig no longer carries a flat field for it.
+	var localAddrs []string
+	for _, g := range s.conf.LocalPTRResolvers {
+		localAddrs = append(localAddrs, g.Upstreams...)
+	}
+
+	err = s.setupResolvers(localAddrs)
 	if err != nil {
 		return fmt.Errorf("setting up resolvers: %w", err)
 	}
@@ -480,6 +599,11 @@ func (s *Server) Stop() error {
 
 // stopLocked stops the DNS server without locking. For internal use only.
 func (s *Server) stopLocked() error {
+	if s.upstreamHealth != nil {
+		s.upstreamHealth.Stop()
+		s.upstreamHealth = nil
+	}
+
 	if s.dnsProxy != nil {
 		err := s.dnsProxy.Stop()
 		if err != nil {
@@ -523,6 +647,15 @@ func (s *Server) Reconfigure(config *ServerConfig) error {
 		return fmt.Errorf("could not reconfigure the server: %w", err)
 	}
 
+	// s is already locked at this point, so purge the caches directly
+	// instead of going through PurgeRDNSCache, which takes the lock
+	// itself for use by callers such as the DHCP lease-change callback set
+	// in NewServer.
+	s.rdnsCache.purge()
+	if s.ptrRouter != nil {
+		s.ptrRouter.Purge()
+	}
+
 	return nil
 }
 
@@ -0,0 +1,181 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/miekg/dns"
+)
+
+// PTRResolverGroup describes a named group of upstreams used for reverse
+// (PTR) resolution, along with the CIDR ranges that should be routed to it.
+// It is the structured replacement for the former flat
+// ServerConfig.LocalPTRResolvers string slice.
+type PTRResolverGroup struct {
+	// Name uniquely identifies the group, e.g. "corp-dns" or "router".  It
+	// is only used for diagnostics.
+	Name string `yaml:"name"`
+
+	// Subnets are the CIDR ranges whose reverse lookups should be routed
+	// to this group.  An entry with no subnets is never selected by
+	// routing; its upstreams, like those of every group, are still used as
+	// the server's local resolvers for locally-served networks.
+	Subnets []string `yaml:"subnets"`
+
+	// Upstreams are the addresses of the resolvers to use for this group,
+	// in the same format as ServerConfig.UpstreamDNS.
+	Upstreams []string `yaml:"upstreams"`
+}
+
+// ptrRoute is a single parsed CIDR-to-group mapping.
+type ptrRoute struct {
+	network *net.IPNet
+	group   string
+}
+
+// ptrNegativeTTL is how long a failed reverse lookup is cached to avoid
+// hammering upstreams with repeated queries for unresolvable addresses.
+const ptrNegativeTTL = 1 * time.Minute
+
+// ptrNegativeCache remembers recent failed reverse lookups.
+type ptrNegativeCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// newPTRNegativeCache returns an empty negative cache.
+func newPTRNegativeCache() (c *ptrNegativeCache) {
+	return &ptrNegativeCache{entries: map[string]time.Time{}}
+}
+
+// isNegative reports whether ip has a recent failed lookup recorded against
+// it.
+func (c *ptrNegativeCache) isNegative(ip net.IP) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	exp, ok := c.entries[ip.String()]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(exp) {
+		delete(c.entries, ip.String())
+
+		return false
+	}
+
+	return true
+}
+
+// addNegative records a failed lookup for ip.
+func (c *ptrNegativeCache) addNegative(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[ip.String()] = time.Now().Add(ptrNegativeTTL)
+}
+
+// purge removes every entry from the cache.
+func (c *ptrNegativeCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]time.Time{}
+}
+
+// PTRRouter maps client IP addresses to the named resolver group that should
+// handle their reverse lookup, based on the longest matching CIDR prefix.
+type PTRRouter struct {
+	routes   []ptrRoute
+	groups   map[string]aghnet.Exchanger
+	negCache *ptrNegativeCache
+}
+
+// NewPTRRouter builds a PTRRouter from the given groups.  Groups with no
+// subnets are still initialized, but they never win a route lookup, and
+// PTRRouter has no method to query a group by name.
+func NewPTRRouter(groups []PTRResolverGroup, timeout time.Duration) (r *PTRRouter, err error) {
+	r = &PTRRouter{
+		groups:   make(map[string]aghnet.Exchanger, len(groups)),
+		negCache: newPTRNegativeCache(),
+	}
+
+	for _, g := range groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("ptr router: group has no name")
+		}
+
+		ex, exErr := aghnet.NewMultiAddrExchanger(g.Upstreams, timeout)
+		if exErr != nil {
+			return nil, fmt.Errorf("ptr router: group %q: %w", g.Name, exErr)
+		}
+		r.groups[g.Name] = ex
+
+		for _, s := range g.Subnets {
+			_, ipNet, cidrErr := net.ParseCIDR(s)
+			if cidrErr != nil {
+				return nil, fmt.Errorf("ptr router: group %q: subnet %q: %w", g.Name, s, cidrErr)
+			}
+
+			r.routes = append(r.routes, ptrRoute{network: ipNet, group: g.Name})
+		}
+	}
+
+	return r, nil
+}
+
+// Route returns the name of the group that should handle the reverse lookup
+// for ip, using longest-prefix-match among the overlapping CIDRs.  ok is
+// false if no route matches.
+func (r *PTRRouter) Route(ip net.IP) (group string, ok bool) {
+	bestLen := -1
+	for _, route := range r.routes {
+		if !route.network.Contains(ip) {
+			continue
+		}
+
+		ones, _ := route.network.Mask.Size()
+		if ones > bestLen {
+			bestLen = ones
+			group = route.group
+			ok = true
+		}
+	}
+
+	return group, ok
+}
+
+// Exchange resolves req against the group routed to ip.  It returns
+// ok == false if ip doesn't match any configured route, so that the caller
+// can fall back to another resolution strategy.
+func (r *PTRRouter) Exchange(ip net.IP, req *dns.Msg) (resp *dns.Msg, ok bool, err error) {
+	if r.negCache.isNegative(ip) {
+		return nil, true, rDNSEmptyAnswerErr
+	}
+
+	group, ok := r.Route(ip)
+	if !ok {
+		return nil, false, nil
+	}
+
+	ex, ok := r.groups[group]
+	if !ok {
+		return nil, false, nil
+	}
+
+	resp, err = ex.Exchange(req)
+	if err != nil {
+		r.negCache.addNegative(ip)
+	}
+
+	return resp, true, err
+}
+
+// Purge clears the negative-lookup cache.
+func (r *PTRRouter) Purge() {
+	r.negCache.purge()
+}
@@ -0,0 +1,70 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPTRRouter_Route(t *testing.T) {
+	r, err := NewPTRRouter([]PTRResolverGroup{{
+		Name:    "corp",
+		Subnets: []string{"10.0.0.0/8"},
+	}, {
+		Name:    "router",
+		Subnets: []string{"10.0.0.0/24"},
+	}, {
+		Name:    "v6",
+		Subnets: []string{"fd00::/8"},
+	}}, defaultLocalTimeout)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		ip        net.IP
+		wantGroup string
+		wantOK    bool
+	}{{
+		name:      "longest_prefix_wins",
+		ip:        net.ParseIP("10.0.0.1"),
+		wantGroup: "router",
+		wantOK:    true,
+	}, {
+		name:      "falls_back_to_shorter_prefix",
+		ip:        net.ParseIP("10.0.1.1"),
+		wantGroup: "corp",
+		wantOK:    true,
+	}, {
+		name:      "ipv6",
+		ip:        net.ParseIP("fd00::1"),
+		wantGroup: "v6",
+		wantOK:    true,
+	}, {
+		name:   "unmatched",
+		ip:     net.ParseIP("192.168.1.1"),
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			group, ok := r.Route(tc.ip)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantGroup, group)
+		})
+	}
+}
+
+func TestPTRNegativeCache(t *testing.T) {
+	c := newPTRNegativeCache()
+	ip := net.ParseIP("1.2.3.4")
+
+	assert.False(t, c.isNegative(ip))
+
+	c.addNegative(ip)
+	assert.True(t, c.isNegative(ip))
+
+	c.purge()
+	assert.False(t, c.isNegative(ip))
+}
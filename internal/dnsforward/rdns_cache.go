@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Default TTLs for the reverse-resolution memoization cache.
+const (
+	defaultRDNSPositiveTTL = 1 * time.Hour
+	defaultRDNSNegativeTTL = 10 * time.Minute
+)
+
+// rdnsCacheSize is the maximum number of entries kept in the reverse-DNS
+// cache before the least recently used one is evicted.
+const rdnsCacheSize = 10_000
+
+// rdnsCacheEntry is a single memoized reverse-lookup result.
+type rdnsCacheEntry struct {
+	ip      string
+	host    string
+	ok      bool
+	expires time.Time
+}
+
+// rdnsCache is an LRU cache of reverse-lookup results, with separate TTLs
+// for positive and negative answers, used to memoize Server.Exchange calls
+// for IPs that aren't known from DHCP.
+type rdnsCache struct {
+	mu sync.Mutex
+
+	ll    *list.List
+	items map[string]*list.Element
+
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+}
+
+// newRDNSCache returns an empty cache using the default TTLs.
+func newRDNSCache() (c *rdnsCache) {
+	return &rdnsCache{
+		ll:          list.New(),
+		items:       map[string]*list.Element{},
+		positiveTTL: defaultRDNSPositiveTTL,
+		negativeTTL: defaultRDNSNegativeTTL,
+	}
+}
+
+// get returns the memoized host for ip, if any and not expired.  ok is
+// false both when there's no entry and when the memoized result was a
+// negative one.
+func (c *rdnsCache) get(ip string) (host string, found, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, exists := c.items[ip]
+	if !exists {
+		return "", false, false
+	}
+
+	e := el.Value.(*rdnsCacheEntry)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, ip)
+
+		return "", false, false
+	}
+
+	c.ll.MoveToFront(el)
+
+	return e.host, true, e.ok
+}
+
+// set memoizes host as the result of resolving ip.  ok is false to record a
+// negative (failed) lookup.
+func (c *rdnsCache) set(ip, host string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.positiveTTL
+	if !ok {
+		ttl = c.negativeTTL
+	}
+
+	if el, exists := c.items[ip]; exists {
+		e := el.Value.(*rdnsCacheEntry)
+		e.host, e.ok, e.expires = host, ok, time.Now().Add(ttl)
+		c.ll.MoveToFront(el)
+
+		return
+	}
+
+	el := c.ll.PushFront(&rdnsCacheEntry{
+		ip:      ip,
+		host:    host,
+		ok:      ok,
+		expires: time.Now().Add(ttl),
+	})
+	c.items[ip] = el
+
+	for c.ll.Len() > rdnsCacheSize {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*rdnsCacheEntry).ip)
+	}
+}
+
+// purge removes every entry from the cache.
+func (c *rdnsCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+}
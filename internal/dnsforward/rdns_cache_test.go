@@ -0,0 +1,59 @@
+package dnsforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRDNSCache(t *testing.T) {
+	c := newRDNSCache()
+
+	_, found, _ := c.get("1.2.3.4")
+	assert.False(t, found)
+
+	c.set("1.2.3.4", "host.lan", true)
+	host, found, ok := c.get("1.2.3.4")
+	assert.True(t, found)
+	assert.True(t, ok)
+	assert.Equal(t, "host.lan", host)
+
+	c.set("5.6.7.8", "", false)
+	_, found, ok = c.get("5.6.7.8")
+	assert.True(t, found)
+	assert.False(t, ok)
+
+	c.purge()
+	_, found, _ = c.get("1.2.3.4")
+	assert.False(t, found)
+}
+
+func TestRDNSCache_expiry(t *testing.T) {
+	c := newRDNSCache()
+	c.positiveTTL = time.Millisecond
+
+	c.set("1.2.3.4", "host.lan", true)
+	time.Sleep(5 * time.Millisecond)
+
+	_, found, _ := c.get("1.2.3.4")
+	assert.False(t, found)
+}
+
+func TestRDNSCache_eviction(t *testing.T) {
+	c := newRDNSCache()
+
+	for i := 0; i < rdnsCacheSize+10; i++ {
+		c.set(intToIP(i), "host", true)
+	}
+
+	assert.LessOrEqual(t, c.ll.Len(), rdnsCacheSize)
+}
+
+// intToIP is a small test helper producing unique cache keys.
+func intToIP(i int) (s string) {
+	b := make([]byte, 0, 16)
+	b = append(b, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+
+	return string(b)
+}
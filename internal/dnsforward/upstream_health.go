@@ -0,0 +1,459 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// healthCheckHost is the hostname queried by the active upstream health
+// checker.  It resolves to a stable answer on AdGuard DNS and is cheap for
+// upstreams to answer from cache.
+const healthCheckHost = "health-check.dns.adguard.com."
+
+// Default values for UpstreamHealthCheckConfig.
+const (
+	defaultHealthCheckIvl       = 2 * time.Minute
+	defaultHealthCheckTimeout   = 3 * time.Second
+	defaultHealthCheckThreshold = 3
+	defaultHealthCheckCooldown  = 5 * time.Minute
+)
+
+// UpstreamHealthCheckConfig is the configuration of the active upstream
+// health checker.  It is embedded into ServerConfig.
+type UpstreamHealthCheckConfig struct {
+	// Interval is the period between two consecutive rounds of health
+	// checks.  Zero disables periodic checking.
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout is the per-upstream timeout for a single health-check query.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// UnhealthyThreshold is the number of consecutive failed checks after
+	// which an upstream is considered unhealthy and ordered after every
+	// healthy upstream until it recovers or its cooldown expires.  It stays
+	// in the ordered list.
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+
+	// Cooldown is the minimum time an upstream marked unhealthy is ordered
+	// after the healthy ones before it is considered healthy again.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// withDefaults returns a copy of c with zero fields replaced by defaults.
+func (c UpstreamHealthCheckConfig) withDefaults() (res UpstreamHealthCheckConfig) {
+	res = c
+	if res.Interval == 0 {
+		res.Interval = defaultHealthCheckIvl
+	}
+	if res.Timeout == 0 {
+		res.Timeout = defaultHealthCheckTimeout
+	}
+	if res.UnhealthyThreshold == 0 {
+		res.UnhealthyThreshold = defaultHealthCheckThreshold
+	}
+	if res.Cooldown == 0 {
+		res.Cooldown = defaultHealthCheckCooldown
+	}
+
+	return res
+}
+
+// ewmaAlpha is the smoothing factor used for the latency and error-rate
+// moving averages.  Lower values weigh history more heavily.
+const ewmaAlpha = 0.3
+
+// upstreamHealthState is the mutable health state tracked for a single
+// upstream.
+type upstreamHealthState struct {
+	// addr is the upstream's address, as configured.
+	addr string
+
+	mu sync.RWMutex
+
+	// latencyMs is the EWMA of the round-trip time of health-check
+	// queries, in milliseconds.
+	latencyMs float64
+
+	// errorRate is the EWMA of the health-check failure rate, between 0
+	// and 1.
+	errorRate float64
+
+	// consecutiveFails is the number of health checks that have failed in
+	// a row.
+	consecutiveFails int
+
+	// unhealthySince is the time the upstream was marked unhealthy, or the
+	// zero Time if it's currently considered healthy.
+	unhealthySince time.Time
+
+	// lastErr is the error returned by the most recent health check, if
+	// any.
+	lastErr error
+
+	// lastChecked is the time of the most recent health check.
+	lastChecked time.Time
+}
+
+// recordResult updates the EWMA latency and error-rate estimates and the
+// unhealthy state given the outcome of a single health check.
+func (st *upstreamHealthState) recordResult(rtt time.Duration, checkErr error, cfg UpstreamHealthCheckConfig) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.lastChecked = time.Now()
+	st.lastErr = checkErr
+
+	var sample float64
+	if checkErr != nil {
+		sample = 1
+		st.consecutiveFails++
+	} else {
+		st.consecutiveFails = 0
+		st.latencyMs = ewmaAlpha*float64(rtt.Milliseconds()) + (1-ewmaAlpha)*st.latencyMs
+	}
+	st.errorRate = ewmaAlpha*sample + (1-ewmaAlpha)*st.errorRate
+
+	if st.consecutiveFails >= cfg.UnhealthyThreshold {
+		if st.unhealthySince.IsZero() {
+			st.unhealthySince = st.lastChecked
+		}
+	} else if checkErr == nil && st.lastChecked.Sub(st.unhealthySince) >= cfg.Cooldown {
+		st.unhealthySince = time.Time{}
+	}
+}
+
+// isHealthy reports whether the upstream may currently be used.  An upstream
+// that is past its cooldown is considered healthy again even without a
+// successful recheck, so that it gets a chance to prove itself.
+func (st *upstreamHealthState) isHealthy(cfg UpstreamHealthCheckConfig) (ok bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if st.unhealthySince.IsZero() {
+		return true
+	}
+
+	return time.Since(st.unhealthySince) >= cfg.Cooldown
+}
+
+// UpstreamStatus is a snapshot of a single upstream's health, suitable for
+// exposing through the HTTP API and WriteDiskConfig.
+type UpstreamStatus struct {
+	Address     string    `json:"address"`
+	Healthy     bool      `json:"healthy"`
+	LatencyMs   float64   `json:"latency_ms"`
+	ErrorRate   float64   `json:"error_rate"`
+	LastChecked time.Time `json:"last_checked"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// snapshot returns the current status of st.
+func (st *upstreamHealthState) snapshot(cfg UpstreamHealthCheckConfig) (s UpstreamStatus) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	s = UpstreamStatus{
+		Address:     st.addr,
+		Healthy:     st.unhealthySince.IsZero() || time.Since(st.unhealthySince) >= cfg.Cooldown,
+		LatencyMs:   st.latencyMs,
+		ErrorRate:   st.errorRate,
+		LastChecked: st.lastChecked,
+	}
+	if st.lastErr != nil {
+		s.LastError = st.lastErr.Error()
+	}
+
+	return s
+}
+
+// upstreamHealthChecker runs periodic active health checks against a set of
+// upstreams and exposes an ordering hook that the DNS proxy can use to
+// prefer the healthiest reachable upstream.
+type upstreamHealthChecker struct {
+	conf UpstreamHealthCheckConfig
+
+	// disabled is true when the configuration's Interval was zero before
+	// defaults were applied to conf, i.e. when periodic checking was
+	// explicitly turned off.
+	disabled bool
+
+	mu     sync.Mutex
+	states map[string]*upstreamHealthState
+
+	// applyOrder, if set, is called with the freshly reordered upstream
+	// list after every round of checks, so that the DNS proxy's upstream
+	// selection actually reflects the measured health.
+	applyOrder func([]upstream.Upstream)
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newUpstreamHealthChecker creates a checker for the given upstreams.  conf
+// is normalized with withDefaults before use; its raw Interval is recorded
+// first so that a configured zero still disables periodic checking.
+func newUpstreamHealthChecker(ups []upstream.Upstream, conf UpstreamHealthCheckConfig) (c *upstreamHealthChecker) {
+	disabled := conf.Interval <= 0
+	conf = conf.withDefaults()
+
+	states := make(map[string]*upstreamHealthState, len(ups))
+	for _, u := range ups {
+		addr := u.Address()
+		states[addr] = &upstreamHealthState{addr: addr}
+	}
+
+	return &upstreamHealthChecker{
+		conf:     conf,
+		disabled: disabled,
+		states:   states,
+	}
+}
+
+// Start begins the periodic health-check loop in a new goroutine and
+// immediately applies an initial ordering.  applyOrder is called with the
+// reordered upstreams after every round of checks; it may be nil.  Start is
+// a no-op beyond the initial ordering if periodic checking is disabled.
+func (c *upstreamHealthChecker) Start(ups []upstream.Upstream, applyOrder func([]upstream.Upstream)) {
+	c.applyOrder = applyOrder
+	if c.applyOrder != nil {
+		c.applyOrder(c.Order(ups))
+	}
+
+	if c.disabled {
+		return
+	}
+
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+
+	go c.loop(ups)
+}
+
+// Stop terminates the health-check loop started by Start and waits for it to
+// exit.  It is safe to call Stop on a checker that was never started.
+func (c *upstreamHealthChecker) Stop() {
+	if c.stop == nil {
+		return
+	}
+
+	close(c.stop)
+	<-c.stopped
+}
+
+// loop runs Recheck on every tick of conf.Interval until Stop is called.
+func (c *upstreamHealthChecker) loop(ups []upstream.Upstream) {
+	defer close(c.stopped)
+
+	t := time.NewTicker(c.conf.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			c.Recheck(ups)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// CheckAll runs a health check against every upstream in ups synchronously
+// and records the results.
+func (c *upstreamHealthChecker) CheckAll(ups []upstream.Upstream) {
+	for _, u := range ups {
+		c.check(u)
+	}
+}
+
+// Recheck runs CheckAll against ups and, if an applyOrder callback was
+// given to Start, reorders ups and applies the result immediately
+// afterwards.  This is the entry point both the periodic loop and the
+// manual "recheck now" HTTP handler use, so that a forced recheck also
+// updates which upstream is actually preferred.
+func (c *upstreamHealthChecker) Recheck(ups []upstream.Upstream) {
+	c.CheckAll(ups)
+
+	if c.applyOrder != nil {
+		c.applyOrder(c.Order(ups))
+	}
+}
+
+// check performs a single health-check query against u and records the
+// outcome.
+func (c *upstreamHealthChecker) check(u upstream.Upstream) {
+	st := c.stateFor(u.Address())
+
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   healthCheckHost,
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+
+	start := time.Now()
+	_, err := u.Exchange(req)
+	rtt := time.Since(start)
+
+	st.recordResult(rtt, err, c.conf)
+	if err != nil {
+		log.Debug("dnsforward: health check: upstream %s: %s", u.Address(), err)
+	}
+}
+
+// stateFor returns the health state for addr, creating it if it doesn't
+// exist yet.
+func (c *upstreamHealthChecker) stateFor(addr string) (st *upstreamHealthState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, ok := c.states[addr]
+	if !ok {
+		st = &upstreamHealthState{addr: addr}
+		c.states[addr] = st
+	}
+
+	return st
+}
+
+// Order returns a reordered copy of ups, preferring healthy upstreams over
+// unhealthy ones and, among healthy upstreams, the ones with the lower EWMA
+// latency.  ups itself is not modified.  Start and Recheck pass its result
+// to the applyOrder callback.
+func (c *upstreamHealthChecker) Order(ups []upstream.Upstream) (ordered []upstream.Upstream) {
+	ordered = make([]upstream.Upstream, len(ups))
+	copy(ordered, ups)
+
+	type scored struct {
+		u       upstream.Upstream
+		healthy bool
+		latency float64
+	}
+
+	scoredUps := make([]scored, len(ordered))
+	for i, u := range ordered {
+		st := c.stateFor(u.Address())
+		scoredUps[i] = scored{
+			u:       u,
+			healthy: st.isHealthy(c.conf),
+			latency: st.snapshot(c.conf).LatencyMs,
+		}
+	}
+
+	sortScored(scoredUps, func(a, b scored) bool {
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+
+		return a.latency < b.latency
+	})
+
+	for i, s := range scoredUps {
+		ordered[i] = s.u
+	}
+
+	return ordered
+}
+
+// sortScored is a tiny insertion sort helper kept local to avoid pulling in
+// sort.Slice's reflection overhead for these small, latency-sensitive
+// slices.
+func sortScored[T any](s []T, less func(a, b T) bool) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && less(s[j], s[j-1]); j-- {
+			s[j], s[j-1] = s[j-1], s[j]
+		}
+	}
+}
+
+// Status returns a snapshot of the health of every known upstream, ordered
+// by address for stable output.
+func (c *upstreamHealthChecker) Status() (statuses []UpstreamStatus) {
+	c.mu.Lock()
+	addrs := make([]string, 0, len(c.states))
+	for addr := range c.states {
+		addrs = append(addrs, addr)
+	}
+	c.mu.Unlock()
+
+	sortScored(addrs, func(a, b string) bool { return a < b })
+
+	statuses = make([]UpstreamStatus, len(addrs))
+	for i, addr := range addrs {
+		statuses[i] = c.stateFor(addr).snapshot(c.conf)
+	}
+
+	return statuses
+}
+
+// handleUpstreamHealthStatus is the HTTP handler for the current upstream
+// health status, registered at GET /control/dns_info/upstream_health.
+func (s *Server) handleUpstreamHealthStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	checker := s.upstreamHealth
+	s.RUnlock()
+
+	if checker == nil {
+		http.Error(w, "upstream health checking is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(checker.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleUpstreamHealthRecheck is the HTTP handler that forces an immediate
+// round of health checks, registered at POST
+// /control/dns_info/upstream_health/recheck.
+func (s *Server) handleUpstreamHealthRecheck(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	checker := s.upstreamHealth
+	p := s.dnsProxy
+	s.RUnlock()
+
+	if checker == nil || p == nil {
+		http.Error(w, "upstream health checking is disabled", http.StatusNotFound)
+
+		return
+	}
+
+	checker.Recheck(p.Upstreams)
+
+	err := json.NewEncoder(w).Encode(checker.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// registerUpstreamHealthHandlers registers the HTTP handlers for upstream
+// health status and manual rechecking.  It must be called after
+// s.conf.HTTPRegister has been confirmed non-nil.
+func (s *Server) registerUpstreamHealthHandlers() {
+	s.conf.HTTPRegister(http.MethodGet, "/control/dns_info/upstream_health", s.handleUpstreamHealthStatus)
+	s.conf.HTTPRegister(http.MethodPost, "/control/dns_info/upstream_health/recheck", s.handleUpstreamHealthRecheck)
+}
+
+// upstreamStatuses returns a snapshot of the current upstream health, or nil
+// if there is no checker, i.e. before Prepare or after the server is
+// stopped.  It's used by WriteDiskConfig to surface
+// which upstream is in use and why.
+func (s *Server) upstreamStatuses() (statuses []UpstreamStatus) {
+	if s.upstreamHealth == nil {
+		return nil
+	}
+
+	return s.upstreamHealth.Status()
+}
@@ -0,0 +1,117 @@
+package dnsforward
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUpstream is a trivial upstream.Upstream used in tests that either
+// always succeeds or always fails.
+type fakeUpstream struct {
+	addr string
+	fail bool
+}
+
+// Exchange implements the upstream.Upstream interface for *fakeUpstream.
+func (u *fakeUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	if u.fail {
+		return nil, fmt.Errorf("fakeUpstream: forced failure")
+	}
+
+	return &dns.Msg{}, nil
+}
+
+// Address implements the upstream.Upstream interface for *fakeUpstream.
+func (u *fakeUpstream) Address() (addr string) { return u.addr }
+
+// Close implements the upstream.Upstream interface for *fakeUpstream.
+func (u *fakeUpstream) Close() (err error) { return nil }
+
+func TestUpstreamHealthState_unhealthyCooldown(t *testing.T) {
+	cfg := UpstreamHealthCheckConfig{
+		UnhealthyThreshold: 2,
+		Cooldown:           20 * time.Millisecond,
+	}.withDefaults()
+
+	st := &upstreamHealthState{addr: "1.2.3.4:53"}
+	assert.True(t, st.isHealthy(cfg))
+
+	st.recordResult(time.Millisecond, fmt.Errorf("boom"), cfg)
+	assert.True(t, st.isHealthy(cfg), "one failure shouldn't trip the threshold")
+
+	st.recordResult(time.Millisecond, fmt.Errorf("boom"), cfg)
+	assert.False(t, st.isHealthy(cfg), "two consecutive failures should mark it unhealthy")
+
+	time.Sleep(cfg.Cooldown * 2)
+	assert.True(t, st.isHealthy(cfg), "the upstream should be retried once its cooldown passes")
+
+	st.recordResult(time.Millisecond, nil, cfg)
+	assert.True(t, st.isHealthy(cfg))
+	assert.Equal(t, 0, st.consecutiveFails)
+}
+
+func TestUpstreamHealthChecker_Order(t *testing.T) {
+	healthy := &fakeUpstream{addr: "healthy:53"}
+	unhealthy := &fakeUpstream{addr: "unhealthy:53", fail: true}
+	ups := []upstream.Upstream{unhealthy, healthy}
+
+	c := newUpstreamHealthChecker(ups, UpstreamHealthCheckConfig{
+		UnhealthyThreshold: 1,
+		Cooldown:           time.Hour,
+	})
+
+	// Before any checks have run, every upstream is presumed healthy, so
+	// the original order is preserved.
+	ordered := c.Order(ups)
+	assert.Equal(t, []upstream.Upstream{unhealthy, healthy}, ordered)
+
+	c.CheckAll(ups)
+
+	ordered = c.Order(ups)
+	require.Len(t, ordered, 2)
+	assert.Equal(t, healthy, ordered[0], "the healthy upstream should be preferred first")
+	assert.Equal(t, unhealthy, ordered[1])
+}
+
+func TestUpstreamHealthChecker_Recheck_appliesOrder(t *testing.T) {
+	healthy := &fakeUpstream{addr: "healthy:53"}
+	unhealthy := &fakeUpstream{addr: "unhealthy:53", fail: true}
+	ups := []upstream.Upstream{unhealthy, healthy}
+
+	c := newUpstreamHealthChecker(ups, UpstreamHealthCheckConfig{
+		UnhealthyThreshold: 1,
+		Cooldown:           time.Hour,
+	})
+
+	var applied []upstream.Upstream
+	c.Start(ups, func(ordered []upstream.Upstream) {
+		applied = ordered
+	})
+	t.Cleanup(c.Stop)
+
+	require.Len(t, applied, 2, "Start must apply an initial ordering")
+
+	c.Recheck(ups)
+
+	require.Len(t, applied, 2)
+	assert.Equal(t, healthy, applied[0])
+	assert.Equal(t, unhealthy, applied[1])
+}
+
+func TestUpstreamHealthChecker_Start_disabled(t *testing.T) {
+	ups := []upstream.Upstream{&fakeUpstream{addr: "a:53"}}
+
+	c := newUpstreamHealthChecker(ups, UpstreamHealthCheckConfig{Interval: 0})
+	assert.True(t, c.disabled)
+
+	c.Start(ups, nil)
+	t.Cleanup(c.Stop)
+
+	assert.Nil(t, c.stop, "a zero interval must not start the periodic loop")
+}
@@ -0,0 +1,350 @@
+package querylog
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Field is the name of a searchable query log field understood by the
+// search DSL.
+type Field string
+
+// Fields supported by the search DSL.
+const (
+	FieldClientID      Field = "client.id"
+	FieldClientIP      Field = "client.ip"
+	FieldQuestionName  Field = "question.name"
+	FieldQuestionType  Field = "question.type"
+	FieldResponseCode  Field = "response.code"
+	FieldFilteringRule Field = "filtering.rule"
+	FieldTime          Field = "time"
+)
+
+// Matcher is the comparison operator used in a FieldMatch.
+type Matcher string
+
+// Matchers supported by the search DSL.
+const (
+	// MatchEq compares the field value for equality.  For question.name,
+	// it also matches every subdomain of the value, and a trailing dot on
+	// either side is ignored.
+	MatchEq Matcher = "="
+	// MatchGlob matches the field value against a shell-style glob, e.g.
+	// "*.example.com".
+	MatchGlob Matcher = "~"
+	// MatchRegexp matches the field value against an RE2 regular
+	// expression.
+	MatchRegexp Matcher = "=~"
+)
+
+// Node is a node of the search DSL's abstract syntax tree.  Implementations
+// are *FieldMatch, *AndNode, *OrNode, and *NotNode.
+type Node interface {
+	// Match reports whether the given field values satisfy the node.
+	// get returns the value of a field, and ok is false if the field
+	// doesn't apply to the current entry.
+	Match(get func(Field) (value string, ok bool)) (ok bool)
+
+	// String returns the DSL representation of the node, mainly useful
+	// for the EXPLAIN output and error messages.
+	String() string
+}
+
+// FieldMatch is a leaf node that compares a single field against a value.
+type FieldMatch struct {
+	Field   Field
+	Matcher Matcher
+	Value   string
+
+	re *regexp.Regexp
+}
+
+// Match implements the Node interface for *FieldMatch.
+func (m *FieldMatch) Match(get func(Field) (string, bool)) (ok bool) {
+	v, ok := get(m.Field)
+	if !ok {
+		return false
+	}
+
+	switch m.Matcher {
+	case MatchGlob:
+		matched, _ := path.Match(m.Value, v)
+
+		return matched
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	default:
+		if m.Field == FieldQuestionName {
+			name := strings.TrimSuffix(v, ".")
+			want := strings.TrimSuffix(m.Value, ".")
+
+			return name == want || strings.HasSuffix(name, "."+want)
+		}
+
+		return v == m.Value
+	}
+}
+
+// String implements the Node interface for *FieldMatch.
+func (m *FieldMatch) String() (s string) {
+	return fmt.Sprintf("%s%s%q", m.Field, m.Matcher, m.Value)
+}
+
+// AndNode matches when all of its children match.
+type AndNode struct {
+	Children []Node
+}
+
+// Match implements the Node interface for *AndNode.
+func (n *AndNode) Match(get func(Field) (string, bool)) (ok bool) {
+	for _, c := range n.Children {
+		if !c.Match(get) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String implements the Node interface for *AndNode.
+func (n *AndNode) String() (s string) {
+	return joinNodes(n.Children, "AND")
+}
+
+// OrNode matches when at least one of its children matches.
+type OrNode struct {
+	Children []Node
+}
+
+// Match implements the Node interface for *OrNode.
+func (n *OrNode) Match(get func(Field) (string, bool)) (ok bool) {
+	for _, c := range n.Children {
+		if c.Match(get) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String implements the Node interface for *OrNode.
+func (n *OrNode) String() (s string) {
+	return joinNodes(n.Children, "OR")
+}
+
+// NotNode inverts the result of its child.
+type NotNode struct {
+	Child Node
+}
+
+// Match implements the Node interface for *NotNode.
+func (n *NotNode) Match(get func(Field) (string, bool)) (ok bool) {
+	return !n.Child.Match(get)
+}
+
+// String implements the Node interface for *NotNode.
+func (n *NotNode) String() (s string) {
+	return fmt.Sprintf("NOT %s", n.Child)
+}
+
+// joinNodes renders children separated by op, parenthesized.
+func joinNodes(children []Node, op string) (s string) {
+	parts := make([]string, len(children))
+	for i, c := range children {
+		parts[i] = c.String()
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(parts, fmt.Sprintf(" %s ", op)))
+}
+
+// dslParser parses the textual search DSL into a Node tree.
+//
+// Grammar (informal):
+//
+//	expr   := term (("AND" | "OR") term)*
+//	term   := "NOT" term | "(" expr ")" | match
+//	match  := field ("=" | "~" | "=~") value
+//
+// Values containing spaces must be quoted with double quotes.
+type dslParser struct {
+	tokens []string
+	pos    int
+}
+
+// Parse parses a search DSL query string into a Node tree.
+func Parse(query string) (n Node, err error) {
+	p := &dslParser{tokens: tokenizeDSL(query)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("querylog: empty query")
+	}
+
+	n, err = p.parseExpr()
+	if err != nil {
+		return nil, fmt.Errorf("querylog: parsing query %q: %w", query, err)
+	}
+
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("querylog: parsing query %q: unexpected token %q", query, p.tokens[p.pos])
+	}
+
+	return n, nil
+}
+
+// tokenizeDSL splits query into tokens, keeping double-quoted strings
+// intact and treating parentheses as standalone tokens.
+func tokenizeDSL(query string) (tokens []string) {
+	var cur strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			cur.WriteRune(r)
+		case inQuotes:
+			cur.WriteRune(r)
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+func (p *dslParser) peek() (tok string, ok bool) {
+	if p.pos >= len(p.tokens) {
+		return "", false
+	}
+
+	return p.tokens[p.pos], true
+}
+
+func (p *dslParser) parseExpr() (n Node, err error) {
+	n, err = p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok, ok := p.peek()
+		if !ok {
+			return n, nil
+		}
+
+		op := strings.ToUpper(tok)
+		if op != "AND" && op != "OR" {
+			return n, nil
+		}
+		p.pos++
+
+		rhs, rhsErr := p.parseTerm()
+		if rhsErr != nil {
+			return nil, rhsErr
+		}
+
+		if op == "AND" {
+			n = &AndNode{Children: []Node{n, rhs}}
+		} else {
+			n = &OrNode{Children: []Node{n, rhs}}
+		}
+	}
+}
+
+func (p *dslParser) parseTerm() (n Node, err error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+
+	switch strings.ToUpper(tok) {
+	case "NOT":
+		p.pos++
+		child, childErr := p.parseTerm()
+		if childErr != nil {
+			return nil, childErr
+		}
+
+		return &NotNode{Child: child}, nil
+	case "(":
+		p.pos++
+		inner, innerErr := p.parseExpr()
+		if innerErr != nil {
+			return nil, innerErr
+		}
+
+		closeTok, closeOk := p.peek()
+		if !closeOk || closeTok != ")" {
+			return nil, fmt.Errorf("missing closing paren")
+		}
+		p.pos++
+
+		return inner, nil
+	default:
+		return p.parseMatch()
+	}
+}
+
+// findOperator scans tok left to right and returns the first occurrence of
+// an operator, i.e. the first '=' or '~', along with its matcher and
+// length.  It must not use a fixed-priority substring search per matcher,
+// since that can find a '~' that occurs inside an unquoted value (e.g. in
+// "client.id=abc~def") before the '=' that actually starts the operator.
+// A '=' directly followed by '~' is the regexp operator, so
+// "filtering.rule=~third-party" is a regexp match.
+func findOperator(tok string) (idx int, matcher Matcher, opLen int, ok bool) {
+	for i := 0; i < len(tok); i++ {
+		switch tok[i] {
+		case '=':
+			if i+1 < len(tok) && tok[i+1] == '~' {
+				return i, MatchRegexp, 2, true
+			}
+
+			return i, MatchEq, 1, true
+		case '~':
+			return i, MatchGlob, 1, true
+		}
+	}
+
+	return 0, "", 0, false
+}
+
+func (p *dslParser) parseMatch() (m *FieldMatch, err error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	p.pos++
+
+	idx, matcher, opLen, ok := findOperator(tok)
+	if !ok || idx == 0 {
+		return nil, fmt.Errorf("invalid match expression %q", tok)
+	}
+
+	field := Field(tok[:idx])
+	value := strings.TrimSuffix(strings.TrimPrefix(tok[idx+opLen:], `"`), `"`)
+
+	m = &FieldMatch{Field: field, Matcher: matcher, Value: value}
+	if matcher == MatchRegexp {
+		m.re, err = regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field, err)
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,80 @@
+package querylog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	n, err := Parse(`client.ip="1.2.3.4" AND question.name~"*.example.com"`)
+	require.NoError(t, err)
+
+	get := func(f Field) (string, bool) {
+		switch f {
+		case FieldClientIP:
+			return "1.2.3.4", true
+		case FieldQuestionName:
+			return "www.example.com", true
+		default:
+			return "", false
+		}
+	}
+	assert.True(t, n.Match(get))
+
+	getOther := func(f Field) (string, bool) {
+		switch f {
+		case FieldClientIP:
+			return "5.6.7.8", true
+		case FieldQuestionName:
+			return "www.example.com", true
+		default:
+			return "", false
+		}
+	}
+	assert.False(t, n.Match(getOther))
+}
+
+func TestParse_notAndOr(t *testing.T) {
+	n, err := Parse(`NOT (client.id="known" OR client.id="other")`)
+	require.NoError(t, err)
+
+	assert.False(t, n.Match(func(f Field) (string, bool) { return "known", true }))
+	assert.True(t, n.Match(func(f Field) (string, bool) { return "unknown", true }))
+}
+
+func TestParse_regexp(t *testing.T) {
+	n, err := Parse(`question.name=~"^www\."`)
+	require.NoError(t, err)
+
+	assert.True(t, n.Match(func(Field) (string, bool) { return "www.example.com", true }))
+	assert.False(t, n.Match(func(Field) (string, bool) { return "api.example.com", true }))
+}
+
+func TestParse_valueContainsTilde(t *testing.T) {
+	// A '~' occurring inside an unquoted value must not be mistaken for
+	// the glob operator; the operator starts at the first '=' or '~' in the
+	// token, which here is the '='.
+	n, err := Parse(`client.id=abc~def`)
+	require.NoError(t, err)
+
+	fm, ok := n.(*FieldMatch)
+	require.True(t, ok)
+	assert.Equal(t, FieldClientID, fm.Field)
+	assert.Equal(t, MatchEq, fm.Matcher)
+	assert.Equal(t, "abc~def", fm.Value)
+
+	assert.True(t, n.Match(func(Field) (string, bool) { return "abc~def", true }))
+}
+
+func TestParse_invalid(t *testing.T) {
+	_, err := Parse(``)
+	assert.Error(t, err)
+
+	_, err = Parse(`client.id`)
+	assert.Error(t, err)
+
+	_, err = Parse(`(client.id="a"`)
+	assert.Error(t, err)
+}
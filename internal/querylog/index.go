@@ -0,0 +1,156 @@
+package querylog
+
+import "strings"
+
+// indexKind identifies which inverted index, if any, a query was able to
+// use.  It is reported by Explain to help operators understand performance.
+type indexKind string
+
+// Index kinds reported by Explain.
+const (
+	indexNone     indexKind = "none"
+	indexClientID indexKind = "client.id"
+	indexClientIP indexKind = "client.ip"
+	indexQuestion indexKind = "question.name"
+)
+
+// Explain describes how a search was executed.
+type Explain struct {
+	// IndexUsed is the name of the index consulted to narrow down
+	// candidates, or indexNone if a full scan was performed.
+	IndexUsed indexKind
+
+	// Scanned is the number of entries actually inspected by Match.
+	Scanned int
+
+	// Matched is the number of entries that matched the query.
+	Matched int
+}
+
+// invertedIndex is an in-memory index over the query log's entry buffer,
+// keyed by the fields most commonly filtered on.  Positions are indices
+// into the buffer at the time the index was built; it must be rebuilt (or
+// incrementally extended via add) whenever the buffer changes.
+type invertedIndex struct {
+	byClientID map[string][]int
+	byClientIP map[string][]int
+	// byQuestionSuffix maps each dot-separated suffix of a question name
+	// (e.g. "com", "example.com", "www.example.com") to the positions of
+	// entries whose question matches that suffix, so that both exact and
+	// subdomain lookups are O(1) plus the size of the result set.
+	byQuestionSuffix map[string][]int
+}
+
+// newInvertedIndex returns an empty index.
+func newInvertedIndex() (idx *invertedIndex) {
+	return &invertedIndex{
+		byClientID:       map[string][]int{},
+		byClientIP:       map[string][]int{},
+		byQuestionSuffix: map[string][]int{},
+	}
+}
+
+// add registers the entry at position pos under its client ID, client IP,
+// and every suffix of its question name.
+func (idx *invertedIndex) add(pos int, clientID, clientIP, questionName string) {
+	if clientID != "" {
+		idx.byClientID[clientID] = append(idx.byClientID[clientID], pos)
+	}
+
+	if clientIP != "" {
+		idx.byClientIP[clientIP] = append(idx.byClientIP[clientIP], pos)
+	}
+
+	for _, suffix := range questionSuffixes(questionName) {
+		idx.byQuestionSuffix[suffix] = append(idx.byQuestionSuffix[suffix], pos)
+	}
+}
+
+// questionSuffixes returns every dot-separated suffix of name, including
+// name itself, e.g. "www.example.com." yields
+// ["www.example.com", "example.com", "com"].
+func questionSuffixes(name string) (suffixes []string) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+
+	labels := strings.Split(name, ".")
+	suffixes = make([]string, len(labels))
+	for i := range labels {
+		suffixes[i] = strings.Join(labels[i:], ".")
+	}
+
+	return suffixes
+}
+
+// candidatesFor returns the narrowest set of candidate positions the index
+// can provide for n, along with which index was used.  For an AndNode, it
+// recurses into the children and uses the first indexable leg it finds,
+// since AND only narrows the search space; the full Match call still
+// verifies every condition against each candidate.  If no leg of n can be
+// served from an index, ok is false and the caller must fall back to a full
+// scan.
+func (idx *invertedIndex) candidatesFor(n Node) (positions []int, kind indexKind, ok bool) {
+	switch v := n.(type) {
+	case *FieldMatch:
+		if v.Matcher != MatchEq {
+			return nil, indexNone, false
+		}
+
+		switch v.Field {
+		case FieldClientID:
+			positions, ok = idx.byClientID[v.Value]
+
+			return positions, indexClientID, ok
+		case FieldClientIP:
+			positions, ok = idx.byClientIP[v.Value]
+
+			return positions, indexClientIP, ok
+		case FieldQuestionName:
+			positions, ok = idx.byQuestionSuffix[v.Value]
+
+			return positions, indexQuestion, ok
+		default:
+			return nil, indexNone, false
+		}
+	case *AndNode:
+		for _, c := range v.Children {
+			if positions, kind, ok = idx.candidatesFor(c); ok {
+				return positions, kind, true
+			}
+		}
+
+		return nil, indexNone, false
+	default:
+		return nil, indexNone, false
+	}
+}
+
+// Run evaluates root against total entries, using idx to narrow the set of
+// candidates whenever possible instead of scanning every entry.  get
+// resolves field values for the entry at a given position.  It returns the
+// positions of matching entries, in ascending order, and an Explain
+// describing how the search was executed.
+func Run(idx *invertedIndex, root Node, total int, get func(pos int) func(Field) (string, bool)) (matched []int, explain Explain) {
+	candidates, kind, ok := idx.candidatesFor(root)
+	if !ok {
+		candidates = make([]int, total)
+		for i := range candidates {
+			candidates[i] = i
+		}
+		kind = indexNone
+	}
+
+	for _, pos := range candidates {
+		if root.Match(get(pos)) {
+			matched = append(matched, pos)
+		}
+	}
+
+	return matched, Explain{
+		IndexUsed: kind,
+		Scanned:   len(candidates),
+		Matched:   len(matched),
+	}
+}
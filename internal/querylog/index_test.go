@@ -0,0 +1,119 @@
+package querylog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvertedIndex_Run(t *testing.T) {
+	type rec struct {
+		clientID, clientIP, question string
+	}
+
+	recs := []rec{
+		{clientID: "c1", clientIP: "1.1.1.1", question: "www.example.com."},
+		{clientID: "c2", clientIP: "2.2.2.2", question: "api.example.com."},
+		{clientID: "c1", clientIP: "1.1.1.2", question: "example.org."},
+	}
+
+	idx := newInvertedIndex()
+	for i, r := range recs {
+		idx.add(i, r.clientID, r.clientIP, r.question)
+	}
+
+	get := func(pos int) func(Field) (string, bool) {
+		r := recs[pos]
+
+		return func(f Field) (string, bool) {
+			switch f {
+			case FieldClientID:
+				return r.clientID, true
+			case FieldClientIP:
+				return r.clientIP, true
+			case FieldQuestionName:
+				return r.question, true
+			default:
+				return "", false
+			}
+		}
+	}
+
+	n, err := Parse(`client.id="c1"`)
+	require.NoError(t, err)
+
+	matched, explain := Run(idx, n, len(recs), get)
+	assert.Equal(t, []int{0, 2}, matched)
+	assert.Equal(t, indexClientID, explain.IndexUsed)
+	assert.Equal(t, 2, explain.Scanned)
+
+	n, err = Parse(`question.name="example.com"`)
+	require.NoError(t, err)
+
+	matched, explain = Run(idx, n, len(recs), get)
+	assert.Equal(t, []int{0, 1}, matched)
+	assert.Equal(t, indexQuestion, explain.IndexUsed)
+
+	n, err = Parse(`response.code="3"`)
+	require.NoError(t, err)
+
+	_, explain = Run(idx, n, len(recs), get)
+	assert.Equal(t, indexNone, explain.IndexUsed)
+	assert.Equal(t, len(recs), explain.Scanned)
+}
+
+func TestInvertedIndex_Run_and(t *testing.T) {
+	type rec struct {
+		clientID, clientIP, question string
+	}
+
+	recs := []rec{
+		{clientID: "c1", clientIP: "1.1.1.1", question: "www.example.com."},
+		{clientID: "c2", clientIP: "2.2.2.2", question: "api.example.com."},
+		{clientID: "c1", clientIP: "1.1.1.2", question: "example.org."},
+	}
+
+	idx := newInvertedIndex()
+	for i, r := range recs {
+		idx.add(i, r.clientID, r.clientIP, r.question)
+	}
+
+	get := func(pos int) func(Field) (string, bool) {
+		r := recs[pos]
+
+		return func(f Field) (string, bool) {
+			switch f {
+			case FieldClientID:
+				return r.clientID, true
+			case FieldClientIP:
+				return r.clientIP, true
+			case FieldQuestionName:
+				return r.question, true
+			case FieldResponseCode:
+				return "0", true
+			default:
+				return "", false
+			}
+		}
+	}
+
+	// A compound AND query should still be narrowed by whichever leg is
+	// indexable, instead of falling back to a full scan.
+	n, err := Parse(`client.id="c1" AND response.code="0"`)
+	require.NoError(t, err)
+
+	matched, explain := Run(idx, n, len(recs), get)
+	assert.Equal(t, []int{0, 2}, matched)
+	assert.Equal(t, indexClientID, explain.IndexUsed)
+	assert.Equal(t, 2, explain.Scanned)
+
+	// The indexable leg may be on either side of the AND.
+	n, err = Parse(`response.code="0" AND client.ip="2.2.2.2"`)
+	require.NoError(t, err)
+
+	matched, explain = Run(idx, n, len(recs), get)
+	assert.Equal(t, []int{1}, matched)
+	assert.Equal(t, indexClientIP, explain.IndexUsed)
+	assert.Equal(t, 1, explain.Scanned)
+}
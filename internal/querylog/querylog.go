@@ -0,0 +1,177 @@
+package querylog
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Client is the client information associated with a query log entry.
+type Client struct {
+	IDs  []string
+	Name string
+}
+
+// AddParams contains the parameters for the QueryLog.Add method.
+type AddParams struct {
+	// Question is the DNS question that was asked.
+	Question *dns.Msg
+
+	// ClientID is the persistent client ID, if any.
+	ClientID string
+
+	// ClientIP is the IP address of the client that made the request.
+	ClientIP net.IP
+
+	// ResponseCode is the RCODE of the response, e.g. dns.RcodeSuccess.
+	ResponseCode int
+
+	// FilteringRule is the text of the filtering rule that matched the
+	// request, if any.
+	FilteringRule string
+}
+
+// Config is the query log configuration.
+type Config struct {
+	// FindClient resolves persistent client information by one or more
+	// client IDs.  It returns (nil, nil) when the client is unknown.
+	FindClient func(ids []string) (*Client, error)
+
+	// HTTPRegister registers an HTTP handler.  It may be nil, in which
+	// case the query log's HTTP endpoints aren't exposed.
+	HTTPRegister func(method, url string, handler func(http.ResponseWriter, *http.Request))
+
+	// BaseDir is the directory containing the query log files.
+	BaseDir string
+
+	// RotationIvl is the log rotation interval, in days.
+	RotationIvl int
+
+	// MemSize is the configured size of the in-memory buffer, in entries.
+	// Add doesn't enforce it: the buffer grows without bound and old
+	// entries are never overwritten.
+	MemSize int
+
+	// Enabled tells if the query log is enabled at all.
+	Enabled bool
+
+	// FileEnabled tells if the query log is written to disk, in addition
+	// to being kept in memory.
+	FileEnabled bool
+
+	// AnonymizeClientIP tells if the client IP should be anonymized
+	// before logging.
+	AnonymizeClientIP bool
+}
+
+// QueryLog is a log of DNS queries.
+type QueryLog interface {
+	// Add appends a new entry to the log.
+	Add(params AddParams)
+
+	// Search executes q against the log and returns a streaming iterator
+	// over the results, most recent first.
+	Search(ctx context.Context, q Query) (it *SearchIterator, err error)
+
+	// Close closes the query log.
+	Close()
+}
+
+// logEntry is a single entry of the in-memory buffer.
+type logEntry struct {
+	question      *dns.Msg
+	clientID      string
+	clientIP      net.IP
+	time          time.Time
+	responseCode  int
+	filteringRule string
+
+	// client is the resolved client information, or nil if the client is
+	// unknown or ClientID wasn't set.
+	client *Client
+}
+
+// queryLog implements the QueryLog interface.
+type queryLog struct {
+	conf Config
+
+	mu      sync.Mutex
+	entries []*logEntry
+	index   *invertedIndex
+
+	clientCacheMu sync.Mutex
+	clientCache   map[string]*Client
+	clientKnown   map[string]bool
+}
+
+// newQueryLog creates a new *queryLog using conf.
+func newQueryLog(conf Config) (l *queryLog) {
+	l = &queryLog{
+		conf:        conf,
+		index:       newInvertedIndex(),
+		clientCache: map[string]*Client{},
+		clientKnown: map[string]bool{},
+	}
+
+	l.registerHandlers()
+
+	return l
+}
+
+// Add implements the QueryLog interface for *queryLog.
+func (l *queryLog) Add(params AddParams) {
+	e := &logEntry{
+		question:      params.Question,
+		clientID:      params.ClientID,
+		clientIP:      params.ClientIP,
+		time:          time.Now(),
+		responseCode:  params.ResponseCode,
+		filteringRule: params.FilteringRule,
+	}
+
+	if params.ClientID != "" {
+		e.client = l.resolveClient(params.ClientID)
+	}
+
+	var questionName string
+	if params.Question != nil && len(params.Question.Question) > 0 {
+		questionName = params.Question.Question[0].Name
+	}
+
+	var clientIPStr string
+	if params.ClientIP != nil {
+		clientIPStr = params.ClientIP.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pos := len(l.entries)
+	l.entries = append(l.entries, e)
+	l.index.add(pos, params.ClientID, clientIPStr, questionName)
+}
+
+// resolveClient returns the *Client for id, consulting and populating
+// l.clientCache as necessary, so that repeated entries for the same client
+// don't call conf.FindClient more than once.
+func (l *queryLog) resolveClient(id string) (c *Client) {
+	l.clientCacheMu.Lock()
+	defer l.clientCacheMu.Unlock()
+
+	if l.clientKnown[id] {
+		return l.clientCache[id]
+	}
+
+	c, _ = l.conf.FindClient([]string{id})
+	l.clientCache[id] = c
+	l.clientKnown[id] = true
+
+	return c
+}
+
+// Close implements the QueryLog interface for *queryLog.
+func (l *queryLog) Close() {}
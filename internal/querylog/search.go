@@ -0,0 +1,237 @@
+package querylog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// searchParams describes the simple chronological search used before the
+// DSL was introduced.  It's kept around for the legacy query-log endpoint.
+type searchParams struct {
+	// olderThan is the time before which entries are included.
+	olderThan time.Time
+
+	// limit is the maximum number of entries to return.
+	limit int
+}
+
+// search returns up to params.limit entries older than params.olderThan,
+// most recent first.
+func (l *queryLog) search(params *searchParams) (entries []*logEntry, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := len(l.entries) - 1; i >= 0 && len(entries) < params.limit; i-- {
+		e := l.entries[i]
+		if e.time.After(params.olderThan) {
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Query is a parsed search DSL query together with an optional result
+// limit.  A zero Limit means "no limit".
+type Query struct {
+	Node  Node
+	Limit int
+}
+
+// SearchIterator streams the log entries matched by a Query, most recent
+// first.
+type SearchIterator struct {
+	entries []*logEntry
+	explain Explain
+	pos     int
+}
+
+// Next returns the next matching entry, or ok == false once the iterator is
+// exhausted.
+func (it *SearchIterator) Next() (e *logEntry, ok bool) {
+	if it.pos >= len(it.entries) {
+		return nil, false
+	}
+
+	e = it.entries[it.pos]
+	it.pos++
+
+	return e, true
+}
+
+// Explain returns the statistics describing how the search behind it was
+// executed, e.g. which index was used and how many entries were scanned.
+func (it *SearchIterator) Explain() (ex Explain) {
+	return it.explain
+}
+
+// fieldGetter returns a Field accessor for the entry at pos.
+func (l *queryLog) fieldGetter(pos int) func(Field) (value string, ok bool) {
+	e := l.entries[pos]
+
+	return func(f Field) (value string, ok bool) {
+		switch f {
+		case FieldClientID:
+			return e.clientID, e.clientID != ""
+		case FieldClientIP:
+			if e.clientIP == nil {
+				return "", false
+			}
+
+			return e.clientIP.String(), true
+		case FieldQuestionName:
+			if e.question == nil || len(e.question.Question) == 0 {
+				return "", false
+			}
+
+			return e.question.Question[0].Name, true
+		case FieldQuestionType:
+			if e.question == nil || len(e.question.Question) == 0 {
+				return "", false
+			}
+
+			return dns.TypeToString[e.question.Question[0].Qtype], true
+		case FieldResponseCode:
+			return strconv.Itoa(e.responseCode), true
+		case FieldFilteringRule:
+			return e.filteringRule, e.filteringRule != ""
+		case FieldTime:
+			return e.time.Format(time.RFC3339), true
+		default:
+			return "", false
+		}
+	}
+}
+
+// Search implements the QueryLog interface for *queryLog.  It evaluates the
+// DSL query in q.Node against the in-memory buffer, preferring the
+// inverted index over a full scan whenever q allows it; see Parse for the
+// query grammar.
+func (l *queryLog) Search(ctx context.Context, q Query) (it *SearchIterator, err error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	matched, explain := Run(l.index, q.Node, len(l.entries), l.fieldGetter)
+
+	limit := q.Limit
+	if limit <= 0 || limit > len(matched) {
+		limit = len(matched)
+	}
+
+	entries := make([]*logEntry, 0, limit)
+	for i := len(matched) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, l.entries[matched[i]])
+	}
+
+	return &SearchIterator{entries: entries, explain: explain}, nil
+}
+
+// searchResponse is the JSON shape returned by handleSearch.
+type searchResponse struct {
+	Entries []*logEntry `json:"entries"`
+	Explain *Explain    `json:"explain,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface for *logEntry.  Its
+// fields are unexported so that tests can reach into them directly, so a
+// custom marshaler is needed to expose them over the API.
+func (e *logEntry) MarshalJSON() (data []byte, err error) {
+	var question string
+	if e.question != nil && len(e.question.Question) > 0 {
+		question = e.question.Question[0].Name
+	}
+
+	var clientIP string
+	if e.clientIP != nil {
+		clientIP = e.clientIP.String()
+	}
+
+	return json.Marshal(struct {
+		Time          time.Time `json:"time"`
+		ClientID      string    `json:"client_id,omitempty"`
+		ClientIP      string    `json:"client_ip,omitempty"`
+		Question      string    `json:"question,omitempty"`
+		ResponseCode  int       `json:"response_code,omitempty"`
+		FilteringRule string    `json:"filtering_rule,omitempty"`
+		Client        *Client   `json:"client,omitempty"`
+	}{
+		Time:          e.time,
+		ClientID:      e.clientID,
+		ClientIP:      clientIP,
+		Question:      question,
+		ResponseCode:  e.responseCode,
+		FilteringRule: e.filteringRule,
+		Client:        e.client,
+	})
+}
+
+// handleSearch is the HTTP handler for the DSL-based query-log search
+// endpoint, registered at GET /control/querylog_search.  The query is taken
+// from the "q" parameter, the optional result limit from "limit", and
+// EXPLAIN output is included when "explain=1" is set.
+func (l *queryLog) handleSearch(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	node, err := Parse(params.Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	var limit int
+	if s := params.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "invalid limit: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	it, err := l.Search(r.Context(), Query{Node: node, Limit: limit})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	resp := searchResponse{}
+	for e, ok := it.Next(); ok; e, ok = it.Next() {
+		resp.Entries = append(resp.Entries, e)
+	}
+
+	if params.Get("explain") == "1" {
+		ex := it.Explain()
+		resp.Explain = &ex
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// registerHandlers registers the query log's HTTP handlers, if
+// conf.HTTPRegister is set.
+func (l *queryLog) registerHandlers() {
+	if l.conf.HTTPRegister == nil {
+		return
+	}
+
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_search", l.handleSearch)
+}
@@ -1,6 +1,8 @@
 package querylog
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -93,3 +95,78 @@ func TestQueryLog_Search_findClient(t *testing.T) {
 	assert.Equal(t, knownClientName, gotClient.Name)
 	assert.Equal(t, []string{knownClientID}, gotClient.IDs)
 }
+
+func TestQueryLog_Search_fields(t *testing.T) {
+	l := newQueryLog(Config{
+		FindClient: func(ids []string) (c *Client, err error) { return nil, nil },
+		BaseDir:    t.TempDir(),
+	})
+	t.Cleanup(l.Close)
+
+	blocked := &dns.Msg{
+		Question: []dns.Question{{Name: "ads.example.com", Qtype: dns.TypeA}},
+	}
+	allowed := &dns.Msg{
+		Question: []dns.Question{{Name: "example.com", Qtype: dns.TypeAAAA}},
+	}
+
+	l.Add(AddParams{
+		Question:      blocked,
+		ClientIP:      net.IP{1, 2, 3, 4},
+		ResponseCode:  dns.RcodeNameError,
+		FilteringRule: "||ads.example.com^",
+	})
+	l.Add(AddParams{
+		Question:     allowed,
+		ClientIP:     net.IP{1, 2, 3, 5},
+		ResponseCode: dns.RcodeSuccess,
+	})
+
+	n, err := Parse(`filtering.rule~*ads.example.com*`)
+	require.NoError(t, err)
+
+	it, err := l.Search(context.Background(), Query{Node: n})
+	require.NoError(t, err)
+
+	entries := readAll(it)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "||ads.example.com^", entries[0].filteringRule)
+
+	n, err = Parse(`response.code=0`)
+	require.NoError(t, err)
+
+	it, err = l.Search(context.Background(), Query{Node: n})
+	require.NoError(t, err)
+
+	entries = readAll(it)
+	require.Len(t, entries, 1)
+	assert.Equal(t, dns.RcodeSuccess, entries[0].responseCode)
+
+	n, err = Parse(`question.type=AAAA`)
+	require.NoError(t, err)
+
+	it, err = l.Search(context.Background(), Query{Node: n})
+	require.NoError(t, err)
+
+	entries = readAll(it)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "example.com", entries[0].question.Question[0].Name)
+
+	n, err = Parse(fmt.Sprintf(`time~%d*`, time.Now().Year()))
+	require.NoError(t, err)
+
+	it, err = l.Search(context.Background(), Query{Node: n})
+	require.NoError(t, err)
+
+	entries = readAll(it)
+	require.Len(t, entries, 2, "both entries were added this year")
+}
+
+// readAll drains it into a slice for convenience in assertions.
+func readAll(it *SearchIterator) (entries []*logEntry) {
+	for e, ok := it.Next(); ok; e, ok = it.Next() {
+		entries = append(entries, e)
+	}
+
+	return entries
+}